@@ -0,0 +1,455 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/textproto"
+	"os"
+	"path"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/bradfitz/gomemcache/memcache"
+	"github.com/go-redis/redis/v8"
+)
+
+// httpDir is http.Dir plus the ability to resolve a key to its on-disk path,
+// for use by fileCacheBackend.
+type httpDir struct {
+	http.Dir
+}
+
+// filename resolves name to its path on disk, rooted at d.Dir.
+func (d httpDir) filename(name string) string {
+	dir := string(d.Dir)
+	if dir == "" {
+		dir = "."
+	}
+	return filepath.Join(dir, filepath.FromSlash(path.Clean("/"+name)))
+}
+
+// Metadata describes a cached HTTP response, independent of whichever
+// CacheBackend stored it.
+type Metadata struct {
+	StatusCode int
+	Header     http.Header
+}
+
+// CacheBackend stores and retrieves proxied upstream responses, keyed by the
+// version-prefixed request path. Implementations must be safe for
+// concurrent use, including from multiple processes when the backend is
+// shared (e.g. Redis/Memcached behind a load-balanced deployment).
+type CacheBackend interface {
+	// Get returns the cached body and metadata for key. The returned error
+	// satisfies os.IsNotExist when there is no entry for key.
+	Get(ctx context.Context, key string) (io.ReadCloser, Metadata, error)
+
+	// Put stores res under key, replacing any existing entry. It consumes
+	// res.Body.
+	Put(ctx context.Context, key string, res *http.Response) error
+
+	// Delete removes the entry for key, if any.
+	Delete(ctx context.Context, key string) error
+
+	// Touch replaces the stored metadata headers for key without altering
+	// its body, for persisting the result of a 304 revalidation.
+	Touch(ctx context.Context, key string, header http.Header) error
+
+	// Lock blocks until the caller holds the exclusive right to populate
+	// key. It must be paired with a call to Unlock.
+	Lock(ctx context.Context, key string) error
+
+	// Unlock releases a key previously locked with Lock.
+	Unlock(key string)
+}
+
+// NewCacheBackend builds the CacheBackend selected by $SPA_PROXY_CACHE_BACKEND
+// ("file", the default, "redis" or "memcached").
+func NewCacheBackend(cacheDir string) (CacheBackend, error) {
+	switch backend := os.Getenv(EnvVarPrefix + "CACHE_BACKEND"); backend {
+	case "", "file":
+		return newFileCacheBackend(cacheDir), nil
+	case "redis":
+		return newRedisCacheBackend(
+			os.Getenv(EnvVarPrefix+"REDIS_ADDR"),
+			os.Getenv(EnvVarPrefix+"REDIS_PASSWORD"),
+		), nil
+	case "memcached":
+		return newMemcachedCacheBackend(os.Getenv(EnvVarPrefix + "MEMCACHED_ADDRS")), nil
+	default:
+		return nil, fmt.Errorf("unknown $%sCACHE_BACKEND %q", EnvVarPrefix, backend)
+	}
+}
+
+// fileCacheBackend stores each entry as a file under cacheDir, keeping the
+// existing on-disk layout: the raw HTTP/1.1 wire format of the upstream
+// response, as written by http.Response.Write.
+type fileCacheBackend struct {
+	root httpDir
+
+	locksMu sync.Mutex
+	locks   map[string]*keyLock
+}
+
+// keyLock is a per-key mutex with a reference count, so fileCacheBackend can
+// drop the map entry once nothing is waiting on it rather than retaining one
+// mutex per key ever seen.
+type keyLock struct {
+	mu   sync.Mutex
+	refs int
+}
+
+func newFileCacheBackend(cacheDir string) *fileCacheBackend {
+	return &fileCacheBackend{
+		root:  httpDir{Dir: http.Dir(cacheDir)},
+		locks: map[string]*keyLock{},
+	}
+}
+
+func (fc *fileCacheBackend) Get(ctx context.Context, key string) (io.ReadCloser, Metadata, error) {
+	f, err := fc.root.Open(key)
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+
+	parsedResponse, err := http.ReadResponse(bufio.NewReader(f), nil)
+	if err != nil {
+		f.Close()
+		return nil, Metadata{}, err
+	}
+
+	return &readCloserChain{Reader: parsedResponse.Body, closers: []io.Closer{parsedResponse.Body, f}},
+		Metadata{StatusCode: parsedResponse.StatusCode, Header: parsedResponse.Header},
+		nil
+}
+
+// Put writes res to a temporary file alongside key's target location, then
+// renames it into place. The rename is atomic, so a concurrent Get always
+// either sees the previous complete entry or the new one - never a
+// truncated, mid-write file, as writing to key's final name in place would
+// allow.
+func (fc *fileCacheBackend) Put(ctx context.Context, key string, res *http.Response) error {
+	fullName := fc.root.filename(key)
+	if err := os.MkdirAll(filepath.Dir(fullName), os.ModePerm); err != nil {
+		return err
+	}
+
+	tmpFile, err := ioutil.TempFile(filepath.Dir(fullName), filepath.Base(fullName)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	tmpName := tmpFile.Name()
+	defer os.Remove(tmpName)
+
+	if err := res.Write(tmpFile); err != nil {
+		tmpFile.Close()
+		return err
+	}
+	if err := tmpFile.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmpName, fullName)
+}
+
+func (fc *fileCacheBackend) Delete(ctx context.Context, key string) error {
+	return os.Remove(fc.root.filename(key))
+}
+
+func (fc *fileCacheBackend) Touch(ctx context.Context, key string, header http.Header) error {
+	return touchByRewrite(ctx, fc, key, header)
+}
+
+func (fc *fileCacheBackend) Lock(ctx context.Context, key string) error {
+	fc.locksMu.Lock()
+	lock, ok := fc.locks[key]
+	if !ok {
+		lock = &keyLock{}
+		fc.locks[key] = lock
+	}
+	lock.refs++
+	fc.locksMu.Unlock()
+
+	lock.mu.Lock()
+	return nil
+}
+
+func (fc *fileCacheBackend) Unlock(key string) {
+	fc.locksMu.Lock()
+	lock, ok := fc.locks[key]
+	if ok {
+		lock.refs--
+		if lock.refs == 0 {
+			delete(fc.locks, key)
+		}
+	}
+	fc.locksMu.Unlock()
+	if ok {
+		lock.mu.Unlock()
+	}
+}
+
+// touchByRewrite is a CacheBackend-agnostic implementation of Touch: it reads
+// the existing entry's body, then writes it straight back with the new
+// headers. Backends without a cheaper metadata-only update can use it.
+func touchByRewrite(ctx context.Context, backend CacheBackend, key string, header http.Header) error {
+	body, meta, err := backend.Get(ctx, key)
+	if err != nil {
+		return err
+	}
+	bodyBytes, err := ioutil.ReadAll(body)
+	body.Close()
+	if err != nil {
+		return err
+	}
+
+	return backend.Put(ctx, key, &http.Response{
+		Status:        fmt.Sprintf("%d %s", meta.StatusCode, http.StatusText(meta.StatusCode)),
+		StatusCode:    meta.StatusCode,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          ioutil.NopCloser(bytes.NewReader(bodyBytes)),
+		ContentLength: int64(len(bodyBytes)),
+	})
+}
+
+// readCloserChain reads from Reader and closes every entry in closers, in
+// order, when Close is called.
+type readCloserChain struct {
+	io.Reader
+	closers []io.Closer
+}
+
+func (r *readCloserChain) Close() error {
+	var firstErr error
+	for _, c := range r.closers {
+		if err := c.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// encodeFramedEntry serialises res as status + headers + body, a compact
+// format independent of HTTP/1.1 wire framing, for storage in remote
+// backends that cache a single blob per key rather than a file per key.
+func encodeFramedEntry(res *http.Response) ([]byte, error) {
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	var headerBuf bytes.Buffer
+	if err := res.Header.Write(&headerBuf); err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	var lenField [4]byte
+
+	binary.BigEndian.PutUint32(lenField[:], uint32(res.StatusCode))
+	buf.Write(lenField[:])
+
+	binary.BigEndian.PutUint32(lenField[:], uint32(headerBuf.Len()))
+	buf.Write(lenField[:])
+	buf.Write(headerBuf.Bytes())
+
+	binary.BigEndian.PutUint32(lenField[:], uint32(len(body)))
+	buf.Write(lenField[:])
+	buf.Write(body)
+
+	return buf.Bytes(), nil
+}
+
+// decodeFramedEntry parses the format written by encodeFramedEntry.
+func decodeFramedEntry(raw []byte) (io.ReadCloser, Metadata, error) {
+	r := bytes.NewReader(raw)
+	var lenField [4]byte
+
+	if _, err := io.ReadFull(r, lenField[:]); err != nil {
+		return nil, Metadata{}, err
+	}
+	statusCode := int(binary.BigEndian.Uint32(lenField[:]))
+
+	if _, err := io.ReadFull(r, lenField[:]); err != nil {
+		return nil, Metadata{}, err
+	}
+	headerLen := binary.BigEndian.Uint32(lenField[:])
+	headerBytes := make([]byte, headerLen)
+	if _, err := io.ReadFull(r, headerBytes); err != nil {
+		return nil, Metadata{}, err
+	}
+	tp := textproto.NewReader(bufio.NewReader(bytes.NewReader(headerBytes)))
+	mimeHeader, err := tp.ReadMIMEHeader()
+	if err != nil && err != io.EOF {
+		return nil, Metadata{}, err
+	}
+
+	if _, err := io.ReadFull(r, lenField[:]); err != nil {
+		return nil, Metadata{}, err
+	}
+	bodyLen := binary.BigEndian.Uint32(lenField[:])
+	body := make([]byte, bodyLen)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	return ioutil.NopCloser(bytes.NewReader(body)),
+		Metadata{StatusCode: statusCode, Header: http.Header(mimeHeader)},
+		nil
+}
+
+// redisCacheBackend stores each entry as a single framed blob, shared by
+// every proxy replica pointed at the same Redis instance.
+type redisCacheBackend struct {
+	client *redis.Client
+}
+
+func newRedisCacheBackend(addr, password string) *redisCacheBackend {
+	return &redisCacheBackend{
+		client: redis.NewClient(&redis.Options{
+			Addr:     addr,
+			Password: password,
+		}),
+	}
+}
+
+func (rc *redisCacheBackend) Get(ctx context.Context, key string) (io.ReadCloser, Metadata, error) {
+	raw, err := rc.client.Get(ctx, key).Bytes()
+	if err == redis.Nil {
+		return nil, Metadata{}, os.ErrNotExist
+	}
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	return decodeFramedEntry(raw)
+}
+
+func (rc *redisCacheBackend) Put(ctx context.Context, key string, res *http.Response) error {
+	raw, err := encodeFramedEntry(res)
+	if err != nil {
+		return err
+	}
+	return rc.client.Set(ctx, key, raw, 0).Err()
+}
+
+func (rc *redisCacheBackend) Delete(ctx context.Context, key string) error {
+	return rc.client.Del(ctx, key).Err()
+}
+
+func (rc *redisCacheBackend) Touch(ctx context.Context, key string, header http.Header) error {
+	return touchByRewrite(ctx, rc, key, header)
+}
+
+func (rc *redisCacheBackend) Lock(ctx context.Context, key string) error {
+	lockKey := key + ":lock"
+	for {
+		ok, err := rc.client.SetNX(ctx, lockKey, "1", time.Minute).Result()
+		if err != nil {
+			return err
+		}
+		if ok {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+}
+
+func (rc *redisCacheBackend) Unlock(key string) {
+	rc.client.Del(context.Background(), key+":lock")
+}
+
+// memcachedCacheBackend stores each entry as a single framed blob. Memcached
+// has no native per-key mutex, so locking is approximated with Add, which
+// fails if the lock key already exists.
+type memcachedCacheBackend struct {
+	client *memcache.Client
+}
+
+func newMemcachedCacheBackend(addrs string) *memcachedCacheBackend {
+	servers := []string{addrs}
+	return &memcachedCacheBackend{client: memcache.New(servers...)}
+}
+
+func (mc *memcachedCacheBackend) Get(ctx context.Context, key string) (io.ReadCloser, Metadata, error) {
+	item, err := mc.client.Get(memcacheKey(key))
+	if err == memcache.ErrCacheMiss {
+		return nil, Metadata{}, os.ErrNotExist
+	}
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	return decodeFramedEntry(item.Value)
+}
+
+func (mc *memcachedCacheBackend) Put(ctx context.Context, key string, res *http.Response) error {
+	raw, err := encodeFramedEntry(res)
+	if err != nil {
+		return err
+	}
+	return mc.client.Set(&memcache.Item{Key: memcacheKey(key), Value: raw})
+}
+
+func (mc *memcachedCacheBackend) Delete(ctx context.Context, key string) error {
+	err := mc.client.Delete(memcacheKey(key))
+	if err == memcache.ErrCacheMiss {
+		return nil
+	}
+	return err
+}
+
+func (mc *memcachedCacheBackend) Touch(ctx context.Context, key string, header http.Header) error {
+	return touchByRewrite(ctx, mc, key, header)
+}
+
+func (mc *memcachedCacheBackend) Lock(ctx context.Context, key string) error {
+	lockKey := memcacheKey(key + ":lock")
+	for {
+		err := mc.client.Add(&memcache.Item{Key: lockKey, Value: []byte("1"), Expiration: 60})
+		if err == nil {
+			return nil
+		}
+		if err != memcache.ErrNotStored {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+}
+
+func (mc *memcachedCacheBackend) Unlock(key string) {
+	mc.client.Delete(memcacheKey(key + ":lock"))
+}
+
+// memcacheKey sanitises a cache path into the limited key format memcached
+// accepts (no spaces/control characters, 250 bytes max). Keys longer than
+// that are replaced by their sha256 hash: the naive alternative of slicing
+// off the trailing bytes keeps the asset path but drops the version prefix
+// at the front, colliding different versions of the same long path onto one
+// key.
+func memcacheKey(key string) string {
+	const prefix = "spa-proxy:"
+	if len(prefix)+len(key) <= 250 {
+		return prefix + key
+	}
+	sum := sha256.Sum256([]byte(key))
+	return prefix + hex.EncodeToString(sum[:])
+}
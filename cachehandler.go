@@ -0,0 +1,261 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// fileServer serves proxied upstream responses out of a CacheBackend,
+// fetching and populating the backend on a miss, and revalidating entries
+// that have passed their freshness window.
+type fileServer struct {
+	backend   CacheBackend
+	sourceURL *url.URL
+	client    *http.Client
+
+	// fetchGroup collapses concurrent fetches/revalidations for the same
+	// path into a single upstream request.
+	fetchGroup *singleflight.Group
+
+	// staleWhileRevalidate serves a stale entry immediately, refreshing it
+	// in the background, instead of blocking the request on revalidation.
+	staleWhileRevalidate bool
+}
+
+func (fs fileServer) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+	req.URL.Path = path.Clean(req.URL.Path)
+	key := req.URL.Path
+
+	body, meta, err := fs.backend.Get(ctx, key)
+	if err != nil && !os.IsNotExist(err) {
+		// A concurrent fetch for this key may still be writing the entry;
+		// this unlocked read can observe it mid-write. Treat any parse
+		// failure as a miss rather than failing the request - ensureFresh's
+		// own Get, taken under the backend lock, sees a consistent entry.
+		log.Printf("WARN: unreadable cache entry for %s, refetching: %s", key, err.Error())
+		err = os.ErrNotExist
+	}
+	if os.IsNotExist(err) {
+		if err := fs.ensureFresh(ctx, key, false); err != nil {
+			doError(rw, req, err)
+			return
+		}
+		body, meta, err = fs.backend.Get(ctx, key)
+		if err != nil {
+			doError(rw, req, err)
+			return
+		}
+		fs.writeEntry(rw, "miss", body, meta)
+		return
+	}
+	if err != nil {
+		doError(rw, req, err)
+		return
+	}
+
+	forceRevalidate := parseCacheControl(req.Header.Get("Cache-Control")).noCache
+	if !forceRevalidate && !isStale(meta.Header) {
+		fs.writeEntry(rw, "hit", body, meta)
+		return
+	}
+
+	if !forceRevalidate && fs.staleWhileRevalidate {
+		// Serve the stale entry immediately; refresh it in the background
+		// for the next request.
+		fs.writeEntry(rw, "hit", body, meta)
+		go fs.backgroundRevalidate(key)
+		return
+	}
+	body.Close()
+
+	if err := fs.ensureFresh(ctx, key, forceRevalidate); err != nil {
+		doError(rw, req, err)
+		return
+	}
+	body, meta, err = fs.backend.Get(ctx, key)
+	if err != nil {
+		doError(rw, req, err)
+		return
+	}
+	fs.writeEntry(rw, "revalidated", body, meta)
+}
+
+func (fs fileServer) writeEntry(rw http.ResponseWriter, cacheState string, body io.ReadCloser, meta Metadata) {
+	defer body.Close()
+	copyHeaders(meta.Header, rw.Header())
+	rw.Header().Set("X-Cache", cacheState)
+	rw.WriteHeader(meta.StatusCode)
+	io.Copy(rw, body)
+}
+
+// ensureFresh makes sure the cache holds a fresh entry for key, fetching it
+// cold or revalidating it as needed. Concurrent callers for the same key -
+// including this proxy's other goroutines and, via backend.Lock, other
+// replicas sharing the backend - collapse into a single upstream request.
+// forceRevalidate skips the freshness check and always revalidates upstream,
+// for a request-level Cache-Control: no-cache.
+func (fs fileServer) ensureFresh(ctx context.Context, key string, forceRevalidate bool) error {
+	_, err, _ := fs.fetchGroup.Do(key, func() (interface{}, error) {
+		if err := fs.backend.Lock(ctx, key); err != nil {
+			return nil, err
+		}
+		defer fs.backend.Unlock(key)
+
+		body, meta, err := fs.backend.Get(ctx, key)
+		if err == nil {
+			defer body.Close()
+			if !forceRevalidate && !isStale(meta.Header) {
+				// Another waiter already refreshed this entry.
+				return nil, nil
+			}
+			return nil, fs.revalidate(ctx, key, meta.Header)
+		}
+		if !os.IsNotExist(err) {
+			return nil, err
+		}
+
+		return nil, fs.fetchAndStore(ctx, key)
+	})
+	return err
+}
+
+func (fs fileServer) backgroundRevalidate(key string) {
+	if err := fs.ensureFresh(context.Background(), key, false); err != nil {
+		log.Printf("ERROR: background revalidate %s: %s", key, err.Error())
+	}
+}
+
+// fetchAndStore fetches key from upstream and stores it as a new entry.
+func (fs fileServer) fetchAndStore(ctx context.Context, key string) error {
+	urlOut := &url.URL{
+		Path:   path.Join(fs.sourceURL.Path, key),
+		Scheme: fs.sourceURL.Scheme,
+		Host:   fs.sourceURL.Host,
+	}
+
+	begin := time.Now()
+	res, err := fs.client.Get(urlOut.String())
+	observeUpstreamFetch(begin, err)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	ensureDateHeader(res.Header)
+	return fs.backend.Put(ctx, key, res)
+}
+
+// revalidate issues a conditional GET upstream for key, using the ETag and
+// Last-Modified of the stored entry. A 304 refreshes the stored metadata in
+// place; any other response replaces the entry outright.
+func (fs fileServer) revalidate(ctx context.Context, key string, storedHeader http.Header) error {
+	urlOut := &url.URL{
+		Path:   path.Join(fs.sourceURL.Path, key),
+		Scheme: fs.sourceURL.Scheme,
+		Host:   fs.sourceURL.Host,
+	}
+
+	upstreamReq, err := http.NewRequestWithContext(ctx, http.MethodGet, urlOut.String(), nil)
+	if err != nil {
+		return err
+	}
+	if etag := storedHeader.Get("ETag"); etag != "" {
+		upstreamReq.Header.Set("If-None-Match", etag)
+	}
+	if lastModified := storedHeader.Get("Last-Modified"); lastModified != "" {
+		upstreamReq.Header.Set("If-Modified-Since", lastModified)
+	}
+
+	begin := time.Now()
+	res, err := fs.client.Do(upstreamReq)
+	observeUpstreamFetch(begin, err)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode == http.StatusNotModified {
+		refreshed := storedHeader.Clone()
+		for name, values := range res.Header {
+			refreshed[name] = values
+		}
+		refreshed.Set("Date", time.Now().UTC().Format(http.TimeFormat))
+		return fs.backend.Touch(ctx, key, refreshed)
+	}
+
+	ensureDateHeader(res.Header)
+	return fs.backend.Put(ctx, key, res)
+}
+
+func ensureDateHeader(header http.Header) {
+	if header.Get("Date") == "" {
+		header.Set("Date", time.Now().UTC().Format(http.TimeFormat))
+	}
+}
+
+// cacheControlDirectives is a parsed Cache-Control header, covering the
+// subset this proxy understands.
+type cacheControlDirectives struct {
+	maxAge    time.Duration
+	hasMaxAge bool
+	noCache   bool
+}
+
+func parseCacheControl(header string) cacheControlDirectives {
+	var directives cacheControlDirectives
+	for _, part := range strings.Split(header, ",") {
+		name, value := part, ""
+		if idx := strings.Index(part, "="); idx >= 0 {
+			name, value = part[:idx], strings.Trim(part[idx+1:], `" `)
+		}
+		switch strings.ToLower(strings.TrimSpace(name)) {
+		case "max-age":
+			if seconds, err := strconv.Atoi(strings.TrimSpace(value)); err == nil {
+				directives.maxAge, directives.hasMaxAge = time.Duration(seconds)*time.Second, true
+			}
+		case "no-cache":
+			directives.noCache = true
+		}
+	}
+	return directives
+}
+
+// entryExpiry returns when a cached response, stored at storedAt, should be
+// considered stale. ok is false when the response carries no freshness
+// information, in which case it is never considered stale.
+func entryExpiry(header http.Header, storedAt time.Time) (expiry time.Time, ok bool) {
+	if cc := parseCacheControl(header.Get("Cache-Control")); cc.hasMaxAge {
+		return storedAt.Add(cc.maxAge), true
+	}
+	if expires := header.Get("Expires"); expires != "" {
+		if t, err := http.ParseTime(expires); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+func responseStoredAt(header http.Header) time.Time {
+	if date := header.Get("Date"); date != "" {
+		if t, err := http.ParseTime(date); err == nil {
+			return t
+		}
+	}
+	return time.Now()
+}
+
+func isStale(header http.Header) bool {
+	expiry, ok := entryExpiry(header, responseStoredAt(header))
+	return ok && time.Now().After(expiry)
+}
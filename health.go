@@ -0,0 +1,193 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	requestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "spa_proxy_request_duration_seconds",
+		Help: "Duration of requests served by the proxy, by response status.",
+	}, []string{"status"})
+
+	cacheResultsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "spa_proxy_cache_results_total",
+		Help: "Count of requests by cache result (hit, miss or revalidated).",
+	}, []string{"result"})
+
+	upstreamFetchDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "spa_proxy_upstream_fetch_duration_seconds",
+		Help: "Duration of fetches made to the upstream SOURCE.",
+	}, []string{"outcome"})
+
+	sourceReachableGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "spa_proxy_source_reachable",
+		Help: "1 if the configured SOURCE answered the last health probe with 2xx, else 0.",
+	})
+
+	defaultVersionPollerHealthyGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "spa_proxy_default_version_poller_healthy",
+		Help: "1 if the default-version poller's last fetch succeeded, else 0.",
+	})
+
+	defaultVersionInfoGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "spa_proxy_default_version_info",
+		Help: "Always 1, labeled with the currently served default version.",
+	}, []string{"version"})
+)
+
+func init() {
+	prometheus.MustRegister(
+		requestDuration,
+		cacheResultsTotal,
+		upstreamFetchDuration,
+		sourceReachableGauge,
+		defaultVersionPollerHealthyGauge,
+		defaultVersionInfoGauge,
+	)
+}
+
+// threadSafeBool is a bool that can be read and written from multiple
+// goroutines, following the same pattern as threadSafeString.
+type threadSafeBool struct {
+	mutex sync.RWMutex
+	value bool
+}
+
+func (b *threadSafeBool) Set(val bool) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.value = val
+}
+
+func (b *threadSafeBool) Get() bool {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+	return b.value
+}
+
+var (
+	sourceReachableState       = &threadSafeBool{}
+	defaultVersionPollerHealth = &threadSafeBool{}
+	readyState                 = &threadSafeBool{}
+)
+
+// updateDefaultVersionMetric sets the default-version gauge's label to
+// version, clearing any previous one.
+func updateDefaultVersionMetric(version string) {
+	defaultVersionInfoGauge.Reset()
+	defaultVersionInfoGauge.WithLabelValues(version).Set(1)
+}
+
+// observeUpstreamFetch records how long an upstream fetch took, labeled by
+// whether it succeeded.
+func observeUpstreamFetch(begin time.Time, err error) {
+	outcome := "success"
+	if err != nil {
+		outcome = "error"
+	}
+	upstreamFetchDuration.WithLabelValues(outcome).Observe(time.Since(begin).Seconds())
+}
+
+// runSourceHealthChecks probes sourceURL on interval, the same way a
+// Kubernetes httpGet probe would: success requires a 2xx within the client's
+// timeout. It updates both the health endpoint state and the Prometheus
+// gauge, and never returns.
+func runSourceHealthChecks(client *http.Client, sourceURL string, interval time.Duration) {
+	check := func() {
+		res, err := client.Get(sourceURL)
+		ok := err == nil && res.StatusCode >= 200 && res.StatusCode < 300
+		if res != nil {
+			res.Body.Close()
+		}
+
+		sourceReachableState.Set(ok)
+		if ok {
+			sourceReachableGauge.Set(1)
+		} else {
+			sourceReachableGauge.Set(0)
+		}
+	}
+
+	for {
+		check()
+		time.Sleep(interval)
+	}
+}
+
+// Metrics records request count/latency by status and cache result.
+func Metrics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		begin := time.Now()
+		recorder := &responseRecorder{ResponseWriter: rw}
+		next.ServeHTTP(recorder, req)
+
+		status := recorder.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		requestDuration.WithLabelValues(strconv.Itoa(status)).Observe(time.Since(begin).Seconds())
+
+		if cacheResult := recorder.header.Get("X-Cache"); cacheResult != "" {
+			cacheResultsTotal.WithLabelValues(cacheResult).Inc()
+		}
+	})
+}
+
+// healthHandler reports the two outage modes that are otherwise invisible:
+// the upstream SOURCE being unreachable, and the default-version poller
+// silently failing its retry loop.
+func healthHandler(rw http.ResponseWriter, req *http.Request) {
+	sourceOK := sourceReachableState.Get()
+	pollerOK := defaultVersionPollerHealth.Get()
+
+	status := http.StatusOK
+	if !sourceOK || !pollerOK {
+		status = http.StatusServiceUnavailable
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(status)
+	fmt.Fprintf(rw, `{"sourceReachable":%t,"defaultVersionPollerHealthy":%t}`, sourceOK, pollerOK)
+}
+
+// readyHandler reports 503 until the first default-version poll has
+// succeeded, so Kubernetes can gate traffic until then.
+func readyHandler(rw http.ResponseWriter, req *http.Request) {
+	if !readyState.Get() {
+		rw.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	rw.WriteHeader(http.StatusOK)
+}
+
+// signHandler mints a signed version-override cookie value for ?version=,
+// for QA workflows that need to hand out a pinned-version link without
+// relying on the JS-writable plain cookie. Gated by HTTP Basic Auth since it
+// lets the caller mint a valid override for any version string.
+func signHandler(cookieSecret []byte, username, password string) http.HandlerFunc {
+	return func(rw http.ResponseWriter, req *http.Request) {
+		user, pass, ok := req.BasicAuth()
+		if !ok || subtle.ConstantTimeCompare([]byte(user), []byte(username)) != 1 ||
+			subtle.ConstantTimeCompare([]byte(pass), []byte(password)) != 1 {
+			rw.Header().Set("WWW-Authenticate", `Basic realm="spa-proxy"`)
+			http.Error(rw, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		version := req.URL.Query().Get("version")
+		if version == "" {
+			http.Error(rw, "missing ?version=", http.StatusBadRequest)
+			return
+		}
+
+		fmt.Fprint(rw, signCookieValue(cookieSecret, version, time.Now().Add(versionCookieTTL)))
+	}
+}
@@ -1,23 +1,31 @@
 package main
 
 import (
-	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
-	"errors"
 	"fmt"
-	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"net/url"
 	"os"
 	"path"
-	"path/filepath"
+	"regexp"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"golang.org/x/sync/singleflight"
 )
 
+// healthCheckInterval is how often $SPA_PROXY_SOURCE is actively probed for
+// the /_spa-proxy/health endpoint.
+const healthCheckInterval = 30 * time.Second
+
 const EnvVarPrefix = "SPA_PROXY_"
 
 func main() {
@@ -32,6 +40,9 @@ func main() {
 	var defaultVersion StringReader
 	if specifiedDefaultVersion := os.Getenv(EnvVarPrefix + "DEFAULT_VERSION"); specifiedDefaultVersion != "" {
 		defaultVersion = normalStringReader(specifiedDefaultVersion)
+		defaultVersionPollerHealth.Set(true)
+		readyState.Set(true)
+		updateDefaultVersionMetric(specifiedDefaultVersion)
 	} else {
 		defaultVersion, err = defaultVersionPoller(sourceClient, sourceURLString+"/default-version.txt")
 		if err != nil {
@@ -44,16 +55,40 @@ func main() {
 		log.Fatalf("Invalid url in $%sSOURCE: %s", EnvVarPrefix, err.Error())
 	}
 
+	go runSourceHealthChecks(sourceClient, sourceURLString+"/default-version.txt", healthCheckInterval)
+
 	cacheDir := os.Getenv(EnvVarPrefix + "CACHE_DIR")
+	cacheBackend, err := NewCacheBackend(cacheDir)
+	if err != nil {
+		log.Fatalf("Configuring cache backend: %s", err.Error())
+	}
 	handler = fileServer{
-		root:      httpDir{Dir: http.Dir(cacheDir)},
-		sourceURL: sourceURL,
-		client:    sourceClient,
+		backend:              cacheBackend,
+		sourceURL:            sourceURL,
+		client:               sourceClient,
+		fetchGroup:           &singleflight.Group{},
+		staleWhileRevalidate: os.Getenv(EnvVarPrefix+"STALE_WHILE_REVALIDATE") != "",
+	}
+
+	ruleEngine := DefaultRuleEngine()
+	if rulesFile := os.Getenv(EnvVarPrefix + "RULES"); rulesFile != "" {
+		loadedRules, err := LoadRuleEngine(rulesFile)
+		if err != nil {
+			log.Fatalf("Loading Rules %s", err.Error())
+		}
+		ruleEngine = loadedRules
 	}
 
-	handler = VersionSwitch(defaultVersion)(handler)
-	handler = AppRewrite(handler)
+	versionAllowlist, err := loadVersionAllowlist(sourceClient, os.Getenv(EnvVarPrefix+"VERSION_ALLOWLIST"))
+	if err != nil {
+		log.Fatalf("Configuring $%sVERSION_ALLOWLIST: %s", EnvVarPrefix, err.Error())
+	}
+	cookieSecret := []byte(os.Getenv(EnvVarPrefix + "COOKIE_SECRET"))
+
+	handler = VersionSwitch(defaultVersion, versionAllowlist, cookieSecret)(handler)
+	handler = ruleEngine.Middleware(handler)
 	handler = Logger(handler)
+	handler = Metrics(handler)
 
 	if proxyConfigFile := os.Getenv(EnvVarPrefix + "DEV_PATHS"); proxyConfigFile != "" {
 		proxyConfig := []ProxyConfig{}
@@ -63,8 +98,17 @@ func main() {
 		handler = ProxyPaths(proxyConfig)(handler)
 	}
 
+	mux := http.NewServeMux()
+	mux.HandleFunc("/_spa-proxy/health", healthHandler)
+	mux.HandleFunc("/_spa-proxy/ready", readyHandler)
+	mux.Handle("/_spa-proxy/metrics", promhttp.Handler())
+	if signUser := os.Getenv(EnvVarPrefix + "SIGN_USER"); signUser != "" {
+		mux.HandleFunc("/_spa-proxy/sign", signHandler(cookieSecret, signUser, os.Getenv(EnvVarPrefix+"SIGN_PASS")))
+	}
+	mux.Handle("/", handler)
+
 	bindAddress := os.Getenv(EnvVarPrefix + "BIND")
-	if err := http.ListenAndServe(bindAddress, handler); err != nil {
+	if err := http.ListenAndServe(bindAddress, mux); err != nil {
 		log.Fatal(err.Error())
 	}
 }
@@ -128,18 +172,26 @@ func defaultVersionPoller(client *http.Client, url string) (StringReader, error)
 	versionString := &threadSafeString{
 		value: defaultVersion,
 	}
+	defaultVersionPollerHealth.Set(true)
+	readyState.Set(true)
+	updateDefaultVersionMetric(defaultVersion)
 
 	go func() {
 		for {
 			newVersion, err := fetchVersion()
 			if err != nil {
 				log.Println(err.Error())
+				defaultVersionPollerHealth.Set(false)
+				defaultVersionPollerHealthyGauge.Set(0)
 				time.Sleep(time.Second * 5)
 				continue
 			}
+			defaultVersionPollerHealth.Set(true)
+			defaultVersionPollerHealthyGauge.Set(1)
 
 			changed := versionString.Write(newVersion)
 			if changed {
+				updateDefaultVersionMetric(newVersion)
 				log.Printf("Updating default version to '%s'", newVersion)
 			}
 			time.Sleep(time.Minute)
@@ -149,111 +201,159 @@ func defaultVersionPoller(client *http.Client, url string) (StringReader, error)
 	return versionString, nil
 }
 
-type httpDir struct {
-	http.Dir
-}
+const VersionCookieName = "version-override"
 
-func (d httpDir) Create(name string) (*os.File, error) {
-	// This function is a clone of the Open function in http.Dir, but for
-	// creating rather than opening read-only
-	// Begin Direct Copy
-	if filepath.Separator != '/' && strings.ContainsRune(name, filepath.Separator) {
-		return nil, errors.New("http: invalid character in file path")
-	}
-	dir := string(d.Dir)
-	if dir == "" {
-		dir = "."
-	}
+// versionCookieTTL is how long a minted version-override cookie, signed or
+// not, remains valid before the client falls back to the default version.
+const versionCookieTTL = time.Hour
 
-	fullName := filepath.Join(dir, filepath.FromSlash(path.Clean("/"+name)))
-	// End Direct Copy
+// VersionAllowlist restricts which version strings VersionSwitch will honor
+// from a client-supplied querystring or cookie, via loadVersionAllowlist.
+type VersionAllowlist interface {
+	Allowed(version string) bool
+}
 
-	os.MkdirAll(filepath.Dir(fullName), os.ModePerm)
-	return os.Create(fullName)
+// regexAllowlist allows any version matching a fixed regular expression,
+// configured directly in $SPA_PROXY_VERSION_ALLOWLIST.
+type regexAllowlist struct {
+	pattern *regexp.Regexp
 }
 
-type fileServer struct {
-	root      httpDir
-	sourceURL *url.URL
-	client    *http.Client
+func (a *regexAllowlist) Allowed(version string) bool {
+	return a.pattern.MatchString(version)
 }
 
-func (fs fileServer) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
-	rw.Header().Set("X-Cache", "hit")
-	req.URL.Path = path.Clean(req.URL.Path)
-	err := fs.tryServeFile(rw, req)
-	if os.IsNotExist(err) {
-		rw.Header().Set("X-Cache", "miss")
-		if err := fs.doCacheFetch(rw, req); err != nil {
-			doError(rw, req, err)
-			return
-		}
-		if err := fs.tryServeFile(rw, req); err != nil {
-			doError(rw, req, err)
-			return
-		}
-	} else if err != nil {
-		doError(rw, req, err)
-		return
+// remoteAllowlist allows versions present in a list polled periodically from
+// a remote URL, following the same poll-and-cache pattern as
+// defaultVersionPoller.
+type remoteAllowlist struct {
+	mutex    sync.RWMutex
+	versions map[string]bool
+}
+
+func (a *remoteAllowlist) set(versions []string) {
+	set := make(map[string]bool, len(versions))
+	for _, version := range versions {
+		set[version] = true
 	}
+	a.mutex.Lock()
+	a.versions = set
+	a.mutex.Unlock()
 }
 
-func (fs fileServer) doCacheFetch(rw http.ResponseWriter, req *http.Request) error {
-	// TODO: Exclusive Lock - Will multiple concurrent fetches corrupt the file
-	// or error out?
+func (a *remoteAllowlist) Allowed(version string) bool {
+	a.mutex.RLock()
+	defer a.mutex.RUnlock()
+	return a.versions[version]
+}
 
-	urlOut := &url.URL{
-		Path:   path.Join(fs.sourceURL.Path, req.URL.Path),
-		Scheme: fs.sourceURL.Scheme,
-		Host:   fs.sourceURL.Host,
+// loadVersionAllowlist builds a VersionAllowlist from $SPA_PROXY_VERSION_ALLOWLIST,
+// or returns a nil allowlist if spec is empty (allowlisting is opt-in). A
+// spec starting with "http://" or "https://" is polled as a newline- or
+// space-separated list of valid versions; anything else is compiled as a
+// regular expression.
+func loadVersionAllowlist(client *http.Client, spec string) (VersionAllowlist, error) {
+	if spec == "" {
+		return nil, nil
 	}
-
-	res, err := fs.client.Get(urlOut.String())
+	if strings.HasPrefix(spec, "http://") || strings.HasPrefix(spec, "https://") {
+		return pollVersionAllowlist(client, spec, healthCheckInterval)
+	}
+	pattern, err := regexp.Compile(spec)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	return &regexAllowlist{pattern: pattern}, nil
+}
+
+func pollVersionAllowlist(client *http.Client, url string, interval time.Duration) (*remoteAllowlist, error) {
+	fetchVersions := func() ([]string, error) {
+		res, err := client.Get(url)
+		if err != nil {
+			return nil, err
+		}
+		defer res.Body.Close()
+		if res.StatusCode != 200 {
+			return nil, fmt.Errorf("HTTP %s fetching version allowlist", res.Status)
+		}
+		body, err := ioutil.ReadAll(res.Body)
+		if err != nil {
+			return nil, err
+		}
+		return strings.Fields(string(body)), nil
 	}
 
-	cacheFile, err := fs.root.Create(req.URL.Path)
+	versions, err := fetchVersions()
 	if err != nil {
-		return err
+		return nil, err
 	}
-	defer cacheFile.Close()
 
-	return res.Write(cacheFile)
+	allowlist := &remoteAllowlist{}
+	allowlist.set(versions)
+
+	go func() {
+		for {
+			time.Sleep(interval)
+			versions, err := fetchVersions()
+			if err != nil {
+				log.Printf("ERROR: refreshing version allowlist: %s", err.Error())
+				continue
+			}
+			allowlist.set(versions)
+		}
+	}()
+
+	return allowlist, nil
+}
 
+// signCookieValue mints a version-override cookie value of the form
+// "version|expiry|hex(hmac)", mirroring the secret-box session pattern: the
+// HMAC covers both the version and its expiry, so the cookie can't be
+// replayed past expiry or have its version tampered with.
+func signCookieValue(secret []byte, version string, expiry time.Time) string {
+	payload := version + "|" + strconv.FormatInt(expiry.Unix(), 10)
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(payload))
+	return payload + "|" + hex.EncodeToString(mac.Sum(nil))
 }
 
-func (fs fileServer) tryServeFile(rw http.ResponseWriter, req *http.Request) error {
-	// http.Dir.Open ensures the file is rooted at root.
-	f, err := fs.root.Open(req.URL.Path)
-	if err != nil {
-		return err
+// verifyCookieValue checks the signature and expiry embedded in a value
+// minted by signCookieValue, returning the version if both check out.
+func verifyCookieValue(secret []byte, value string) (version string, ok bool) {
+	parts := strings.SplitN(value, "|", 3)
+	if len(parts) != 3 {
+		return "", false
 	}
-	defer f.Close()
+	version, expiryPart, sigHex := parts[0], parts[1], parts[2]
 
-	buffered := bufio.NewReader(f)
-	parsedResponse, err := http.ReadResponse(buffered, nil)
-	if err != nil {
-		return err
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(version + "|" + expiryPart))
+	expectedSig := mac.Sum(nil)
+
+	sig, err := hex.DecodeString(sigHex)
+	if err != nil || !hmac.Equal(sig, expectedSig) {
+		return "", false
 	}
-	defer parsedResponse.Body.Close()
 
-	// TODO: Discard and delete if cache is expired.
+	expiryUnix, err := strconv.ParseInt(expiryPart, 10, 64)
+	if err != nil || time.Now().Unix() > expiryUnix {
+		return "", false
+	}
 
-	copyHeaders(parsedResponse.Header, rw.Header())
-	rw.WriteHeader(parsedResponse.StatusCode)
-	_, err = io.Copy(rw, parsedResponse.Body)
-	return err
+	return version, true
 }
 
-const VersionCookieName = "version-override"
-
 // VersionSwitch rewrites requests to a directory prefixed with the requested
 // or default version.  The version can be set with a querystirng version= or
 // cookie. When the querystring parameter is set, the cookie is sent with the
 // response so that requests for resources in HTML pages (css, images etc) will
 // also get the correct prefix.
-func VersionSwitch(defaultVersion StringReader) func(http.Handler) http.Handler {
+//
+// If allowlist is non-nil, a querystring or cookie version not on it is
+// rejected. If cookieSecret is non-empty, the cookie is HMAC-signed so only
+// this server - not arbitrary JS - can mint a valid override; an unsigned or
+// tampered cookie is then treated the same as no cookie at all.
+func VersionSwitch(defaultVersion StringReader, allowlist VersionAllowlist, cookieSecret []byte) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
 
@@ -262,32 +362,63 @@ func VersionSwitch(defaultVersion StringReader) func(http.Handler) http.Handler
 				// read the requested version from the QS
 				version = queryVersion
 
+				if allowlist != nil && !allowlist.Allowed(version) {
+					http.Error(rw, "version not allowed", http.StatusBadRequest)
+					return
+				}
+
 				// Set a cookie so that dependencies are also loaded with the
 				// correct version
+				expiry := time.Now().Add(versionCookieTTL)
+				cookieValue := version
+				if len(cookieSecret) > 0 {
+					cookieValue = signCookieValue(cookieSecret, version, expiry)
+				}
 				versionCookie := &http.Cookie{
 					Name: VersionCookieName,
 					// Allowing JS code to view and modify could extend
 					// functionality.
 					HttpOnly: false,
 					Path:     "/",
-					Expires:  time.Now().Add(time.Hour),
-					Value:    version,
+					Expires:  expiry,
+					Value:    cookieValue,
 				}
 				http.SetCookie(rw, versionCookie)
 
 				// Don't cacne versioned entry points
 				rw.Header().Set("Cache-Control", "no-store")
 			} else if versionCookie, _ := req.Cookie(VersionCookieName); versionCookie != nil {
-				// read the requested version from the cookie
-				version = versionCookie.Value
-
-				// refresh the cookie
-				versionCookie.Expires = time.Now().Add(time.Hour)
-				http.SetCookie(rw, versionCookie)
+				// read the requested version from the cookie, verifying its
+				// signature and allowlist membership if configured
+				cookieVersion, valid := versionCookie.Value, true
+				if len(cookieSecret) > 0 {
+					cookieVersion, valid = verifyCookieValue(cookieSecret, cookieVersion)
+				}
+				if valid && allowlist != nil && !allowlist.Allowed(cookieVersion) {
+					valid = false
+				}
 
-				// Don't cache versioned resources (Cookies are not considered
-				// by browsers when looking up cached responses)
-				rw.Header().Set("Cache-Control", "no-store")
+				if !valid {
+					// Treat an invalid cookie the same as no cookie at all,
+					// rather than erroring, so a stale or tampered cookie
+					// can't wedge a client.
+					version = defaultVersion.Read()
+				} else {
+					version = cookieVersion
+
+					// refresh the cookie
+					expiry := time.Now().Add(versionCookieTTL)
+					versionCookie.Expires = expiry
+					if len(cookieSecret) > 0 {
+						versionCookie.Value = signCookieValue(cookieSecret, version, expiry)
+					}
+					http.SetCookie(rw, versionCookie)
+
+					// Don't cache versioned resources (Cookies are not
+					// considered by browsers when looking up cached
+					// responses)
+					rw.Header().Set("Cache-Control", "no-store")
+				}
 			} else {
 				version = defaultVersion.Read()
 			}
@@ -300,16 +431,6 @@ func VersionSwitch(defaultVersion StringReader) func(http.Handler) http.Handler
 	}
 }
 
-// AppRewrite rewrites all requests without an extension to /index.html
-func AppRewrite(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
-		if ext := path.Ext(req.URL.Path); ext == "" {
-			req.URL.Path = "/index.html"
-		}
-		next.ServeHTTP(rw, req)
-	})
-}
-
 func copyHeaders(from, to http.Header) {
 	for headerName, headerValues := range from {
 		for _, headerValue := range headerValues {
@@ -1,12 +1,22 @@
 package main
 
 import (
+	"context"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
+
+	"golang.org/x/sync/singleflight"
 )
 
-func TestAppRewrite(t *testing.T) {
+func TestDefaultRuleEngine(t *testing.T) {
 	for _, tc := range []struct {
 		in     string
 		expect string
@@ -23,7 +33,7 @@ func TestAppRewrite(t *testing.T) {
 		}
 		rw := httptest.NewRecorder()
 		req := httptest.NewRequest("GET", tc.in, nil)
-		AppRewrite(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		DefaultRuleEngine().Middleware(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
 			if req.URL.Path != tc.expect {
 				t.Errorf("Rewrite %s got %s, Expect %s", tc.in, req.URL.Path, tc.expect)
 			}
@@ -31,8 +41,312 @@ func TestAppRewrite(t *testing.T) {
 	}
 }
 
+func TestRuleEngineRedirect(t *testing.T) {
+	engine := &RuleEngine{rules: []Rule{
+		{
+			Match:  RuleMatch{Path: "/old/*"},
+			Action: RuleAction{Type: "redirect", Status: http.StatusMovedPermanently, Location: "/new/"},
+		},
+	}}
+
+	rw := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/old/page", nil)
+	called := false
+	engine.Middleware(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		called = true
+	})).ServeHTTP(rw, req)
+
+	if called {
+		t.Errorf("expected redirect to stop the handler chain")
+	}
+	if rw.Code != http.StatusMovedPermanently {
+		t.Errorf("got status %d, want %d", rw.Code, http.StatusMovedPermanently)
+	}
+	if got := rw.Header().Get("Location"); got != "/new/" {
+		t.Errorf("got Location %q, want /new/", got)
+	}
+}
+
+func TestProxyJoinPath(t *testing.T) {
+	for _, tc := range []struct {
+		base, suffix, expect string
+	}{
+		{base: "/api", suffix: "/users", expect: "/api/users"},
+		{base: "/api/", suffix: "/users", expect: "/api/users"},
+		{base: "/api", suffix: "users", expect: "/api/users"},
+		{base: "/api/", suffix: "users", expect: "/api/users"},
+		{base: "", suffix: "/users", expect: "/users"},
+	} {
+		if got := joinPath(tc.base, tc.suffix); got != tc.expect {
+			t.Errorf("joinPath(%q, %q) = %q, want %q", tc.base, tc.suffix, got, tc.expect)
+		}
+	}
+}
+
+func TestProxyMergeQuery(t *testing.T) {
+	for _, tc := range []struct {
+		base, suffix, expect string
+	}{
+		{base: "", suffix: "", expect: ""},
+		{base: "a=1", suffix: "", expect: "a=1"},
+		{base: "", suffix: "b=2", expect: "b=2"},
+		{base: "a=1", suffix: "b=2", expect: "a=1&b=2"},
+	} {
+		if got := mergeQuery(tc.base, tc.suffix); got != tc.expect {
+			t.Errorf("mergeQuery(%q, %q) = %q, want %q", tc.base, tc.suffix, got, tc.expect)
+		}
+	}
+}
+
+// TestProxyPathsDirector checks end-to-end that ProxyPaths forwards a request
+// matching a configured prefix to its target with the path and query
+// rewritten and the body streamed through untouched, rather than buffered
+// and mangled.
+func TestProxyPathsDirector(t *testing.T) {
+	const body = "console.log('hello')"
+
+	var gotPath, gotQuery, gotForwardedFor string
+	target := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		gotPath = req.URL.Path
+		gotQuery = req.URL.RawQuery
+		gotForwardedFor = req.Header.Get("X-Forwarded-For")
+		fmt.Fprint(rw, body)
+	}))
+	defer target.Close()
+
+	handler := ProxyPaths([]ProxyConfig{
+		{Prefix: "/api", Target: target.URL + "/v2?base=1"},
+	})(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		t.Fatalf("request for %s fell through to next instead of proxying", req.URL.Path)
+	}))
+
+	rw := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/api/users?id=2", nil)
+	req.RemoteAddr = "203.0.113.1:1234"
+	handler.ServeHTTP(rw, req)
+
+	if gotPath != "/v2/api/users" {
+		t.Errorf("got upstream path %q, want /v2/api/users", gotPath)
+	}
+	if gotQuery != "base=1&id=2" {
+		t.Errorf("got upstream query %q, want base=1&id=2", gotQuery)
+	}
+	if !strings.Contains(gotForwardedFor, "203.0.113.1") {
+		t.Errorf("got X-Forwarded-For %q, want it to contain 203.0.113.1", gotForwardedFor)
+	}
+	if got := rw.Body.String(); got != body {
+		t.Errorf("got body %q, want %q", got, body)
+	}
+}
+
+// TestProxyRewriteBodyForcesIdentityEncoding checks that a RewriteBody proxy
+// asks the upstream for an uncompressed response, so rewriteAbsoluteURLs -
+// which only understands plain bytes - actually sees the body it's meant to
+// rewrite instead of silently no-oping against gzipped bytes.
+func TestProxyRewriteBodyForcesIdentityEncoding(t *testing.T) {
+	var targetURL *url.URL
+	var gotAcceptEncoding string
+
+	target := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		gotAcceptEncoding = req.Header.Get("Accept-Encoding")
+		rw.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(rw, `{"next":"%s://%s/asset.js"}`, targetURL.Scheme, targetURL.Host)
+	}))
+	defer target.Close()
+
+	var err error
+	targetURL, err = url.Parse(target.URL)
+	if err != nil {
+		t.Fatalf("parsing target url: %s", err.Error())
+	}
+
+	handler := ProxyPaths([]ProxyConfig{
+		{Prefix: "/api", Target: target.URL, RewriteBody: true},
+	})(http.NotFoundHandler())
+
+	rw := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/api/data", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	handler.ServeHTTP(rw, req)
+
+	if gotAcceptEncoding != "identity" {
+		t.Errorf("upstream saw Accept-Encoding %q, want identity", gotAcceptEncoding)
+	}
+	if got, want := rw.Body.String(), `{"next":"/api/asset.js"}`; got != want {
+		t.Errorf("got rewritten body %q, want %q", got, want)
+	}
+}
+
+// TestDoCacheFetchConcurrentColdRequests fires many simultaneous requests for
+// the same cold path and asserts they collapse into a single upstream fetch,
+// each still getting the correct body.
+func TestDoCacheFetchConcurrentColdRequests(t *testing.T) {
+	const concurrency = 50
+	const body = "console.log('hello')"
+
+	var upstreamHits int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&upstreamHits, 1)
+		fmt.Fprint(rw, body)
+	}))
+	defer upstream.Close()
+
+	sourceURL, err := url.Parse(upstream.URL)
+	if err != nil {
+		t.Fatalf("parsing upstream url: %s", err.Error())
+	}
+
+	fs := fileServer{
+		backend:    newFileCacheBackend(t.TempDir()),
+		sourceURL:  sourceURL,
+		client:     upstream.Client(),
+		fetchGroup: &singleflight.Group{},
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rw := httptest.NewRecorder()
+			req := httptest.NewRequest("GET", "/app.js", nil)
+			fs.ServeHTTP(rw, req)
+
+			if got := rw.Body.String(); got != body {
+				t.Errorf("got body %q, want %q", got, body)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if got := atomic.LoadInt32(&upstreamHits); got != 1 {
+		t.Errorf("got %d upstream fetches, want 1", got)
+	}
+}
+
+// TestFileCacheBackendLockDoesNotLeak checks that fileCacheBackend.locks
+// doesn't retain an entry per key ever locked: once a key's last holder
+// calls Unlock, its entry is removed from the map.
+func TestFileCacheBackendLockDoesNotLeak(t *testing.T) {
+	fc := newFileCacheBackend(t.TempDir())
+	ctx := context.Background()
+
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("/app-%d.js", i)
+		if err := fc.Lock(ctx, key); err != nil {
+			t.Fatalf("Lock(%s): %s", key, err.Error())
+		}
+		fc.Unlock(key)
+	}
+
+	if got := len(fc.locks); got != 0 {
+		t.Errorf("got %d entries left in locks, want 0", got)
+	}
+}
+
+// TestCacheRevalidation checks that an expired entry is revalidated with a
+// conditional GET, and that a 304 response is reported as "revalidated"
+// rather than a fresh "miss".
+func TestCacheRevalidation(t *testing.T) {
+	const etag = `"v1"`
+	const body = "console.log('hello')"
+
+	var upstreamHits int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&upstreamHits, 1)
+		if req.Header.Get("If-None-Match") == etag {
+			rw.WriteHeader(http.StatusNotModified)
+			return
+		}
+		rw.Header().Set("ETag", etag)
+		rw.Header().Set("Cache-Control", "max-age=0")
+		fmt.Fprint(rw, body)
+	}))
+	defer upstream.Close()
+
+	sourceURL, err := url.Parse(upstream.URL)
+	if err != nil {
+		t.Fatalf("parsing upstream url: %s", err.Error())
+	}
+
+	fs := fileServer{
+		backend:    newFileCacheBackend(t.TempDir()),
+		sourceURL:  sourceURL,
+		client:     upstream.Client(),
+		fetchGroup: &singleflight.Group{},
+	}
+
+	first := httptest.NewRecorder()
+	fs.ServeHTTP(first, httptest.NewRequest("GET", "/app.js", nil))
+	if got := first.Header().Get("X-Cache"); got != "miss" {
+		t.Fatalf("first request X-Cache = %q, want miss", got)
+	}
+
+	second := httptest.NewRecorder()
+	fs.ServeHTTP(second, httptest.NewRequest("GET", "/app.js", nil))
+	if got := second.Header().Get("X-Cache"); got != "revalidated" {
+		t.Fatalf("second request X-Cache = %q, want revalidated", got)
+	}
+	if got := second.Body.String(); got != body {
+		t.Fatalf("second request body = %q, want %q", got, body)
+	}
+	if got := atomic.LoadInt32(&upstreamHits); got != 2 {
+		t.Fatalf("got %d upstream hits, want 2", got)
+	}
+}
+
+// TestCacheNoCacheForcesRevalidation checks that a request-level
+// Cache-Control: no-cache revalidates upstream even when the stored entry is
+// still fresh, and is reported as "revalidated" rather than "hit".
+func TestCacheNoCacheForcesRevalidation(t *testing.T) {
+	const etag = `"v1"`
+	const body = "console.log('hello')"
+
+	var upstreamHits int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&upstreamHits, 1)
+		if req.Header.Get("If-None-Match") == etag {
+			rw.WriteHeader(http.StatusNotModified)
+			return
+		}
+		rw.Header().Set("ETag", etag)
+		rw.Header().Set("Cache-Control", "max-age=3600")
+		fmt.Fprint(rw, body)
+	}))
+	defer upstream.Close()
+
+	sourceURL, err := url.Parse(upstream.URL)
+	if err != nil {
+		t.Fatalf("parsing upstream url: %s", err.Error())
+	}
+
+	fs := fileServer{
+		backend:    newFileCacheBackend(t.TempDir()),
+		sourceURL:  sourceURL,
+		client:     upstream.Client(),
+		fetchGroup: &singleflight.Group{},
+	}
+
+	first := httptest.NewRecorder()
+	fs.ServeHTTP(first, httptest.NewRequest("GET", "/app.js", nil))
+	if got := first.Header().Get("X-Cache"); got != "miss" {
+		t.Fatalf("first request X-Cache = %q, want miss", got)
+	}
+
+	req := httptest.NewRequest("GET", "/app.js", nil)
+	req.Header.Set("Cache-Control", "no-cache")
+	second := httptest.NewRecorder()
+	fs.ServeHTTP(second, req)
+	if got := second.Header().Get("X-Cache"); got != "revalidated" {
+		t.Fatalf("second request X-Cache = %q, want revalidated", got)
+	}
+	if got := atomic.LoadInt32(&upstreamHits); got != 2 {
+		t.Fatalf("got %d upstream hits, want 2 (no-cache must force an upstream revalidation of a fresh entry)", got)
+	}
+}
+
 func TestVersionSwitch(t *testing.T) {
-	versionSwitch := VersionSwitch(func() string { return "default" })
+	versionSwitch := VersionSwitch(normalStringReader("default"), nil, nil)
 
 	for _, tc := range []struct {
 		name         string
@@ -117,3 +431,107 @@ func TestVersionSwitch(t *testing.T) {
 		})
 	}
 }
+
+func TestVersionSwitchAllowlist(t *testing.T) {
+	allowlist := &regexAllowlist{pattern: regexp.MustCompile(`^v[0-9]+$`)}
+	versionSwitch := VersionSwitch(normalStringReader("default"), allowlist, nil)
+
+	t.Run("Allowed version passes through", func(t *testing.T) {
+		rw := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/index.html?version=v1", nil)
+		called := false
+		versionSwitch(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			called = true
+			if req.URL.Path != "/v1/index.html" {
+				t.Errorf("got path %s, want /v1/index.html", req.URL.Path)
+			}
+		})).ServeHTTP(rw, req)
+		if !called {
+			t.Errorf("expected handler chain to run")
+		}
+	})
+
+	t.Run("Disallowed version is rejected", func(t *testing.T) {
+		rw := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/index.html?version=../etc", nil)
+		called := false
+		versionSwitch(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			called = true
+		})).ServeHTTP(rw, req)
+		if called {
+			t.Errorf("expected disallowed version to stop the handler chain")
+		}
+		if rw.Code != http.StatusBadRequest {
+			t.Errorf("got status %d, want %d", rw.Code, http.StatusBadRequest)
+		}
+	})
+}
+
+func TestVersionSwitchSignedCookie(t *testing.T) {
+	secret := []byte("test-secret")
+	versionSwitch := VersionSwitch(normalStringReader("default"), nil, secret)
+
+	t.Run("Querystring mints a signed cookie the server then trusts", func(t *testing.T) {
+		first := httptest.NewRecorder()
+		firstReq := httptest.NewRequest("GET", "/index.html?version=v1", nil)
+		versionSwitch(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})).ServeHTTP(first, firstReq)
+
+		var signedCookie *http.Cookie
+		for _, cookie := range first.Result().Cookies() {
+			if cookie.Name == VersionCookieName {
+				signedCookie = cookie
+			}
+		}
+		if signedCookie == nil {
+			t.Fatalf("expected a signed version cookie")
+		}
+		if signedCookie.Value == "v1" {
+			t.Fatalf("expected cookie to be signed, got plain value")
+		}
+
+		second := httptest.NewRecorder()
+		secondReq := httptest.NewRequest("GET", "/style.css", nil)
+		secondReq.AddCookie(signedCookie)
+		var gotPath string
+		versionSwitch(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			gotPath = req.URL.Path
+		})).ServeHTTP(second, secondReq)
+		if gotPath != "/v1/style.css" {
+			t.Errorf("got path %s, want /v1/style.css", gotPath)
+		}
+	})
+
+	t.Run("Tampered cookie falls back to the default version", func(t *testing.T) {
+		tampered := &http.Cookie{
+			Name:  VersionCookieName,
+			Value: signCookieValue(secret, "v1", time.Now().Add(time.Hour)) + "tampered",
+		}
+		rw := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/style.css", nil)
+		req.AddCookie(tampered)
+		var gotPath string
+		versionSwitch(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			gotPath = req.URL.Path
+		})).ServeHTTP(rw, req)
+		if gotPath != "/default/style.css" {
+			t.Errorf("got path %s, want /default/style.css", gotPath)
+		}
+	})
+
+	t.Run("Expired cookie falls back to the default version", func(t *testing.T) {
+		expired := &http.Cookie{
+			Name:  VersionCookieName,
+			Value: signCookieValue(secret, "v1", time.Now().Add(-time.Hour)),
+		}
+		rw := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/style.css", nil)
+		req.AddCookie(expired)
+		var gotPath string
+		versionSwitch(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			gotPath = req.URL.Path
+		})).ServeHTTP(rw, req)
+		if gotPath != "/default/style.css" {
+			t.Errorf("got path %s, want /default/style.css", gotPath)
+		}
+	})
+}
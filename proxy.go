@@ -2,42 +2,45 @@ package main
 
 import (
 	"bytes"
-	"io"
+	"fmt"
 	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
+	"net/http/httputil"
 	"net/url"
 	"strings"
 	"time"
 )
 
+const defaultProxyTimeout = 60 * time.Second
+
 type ProxyConfig struct {
 	Prefix string `json:"prefix"`
 	Target string `json:"target"`
+
+	// Timeout overrides defaultProxyTimeout for this target.
+	Timeout time.Duration `json:"timeout,omitempty"`
+
+	// RewriteBody rewrites absolute URLs pointing at Target, in JSON
+	// response bodies, back to Prefix - so a dev proxy's API responses point
+	// at the proxy rather than leaking the real upstream origin.
+	RewriteBody bool `json:"rewriteBody,omitempty"`
 }
 
+// ProxyPaths dispatches requests under any configured Prefix to an
+// httputil.ReverseProxy for its Target, falling through to next otherwise.
 func ProxyPaths(configs []ProxyConfig) func(http.Handler) http.Handler {
-	var proxyClient = &http.Client{
-		Timeout: time.Second * 60,
+	proxies := make([]*httputil.ReverseProxy, len(configs))
+	for i, proxyConfig := range configs {
+		proxies[i] = newReverseProxy(proxyConfig)
 	}
+
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(responseWriter http.ResponseWriter, request *http.Request) {
-			requestPath := request.URL.Path
-			for _, proxyPath := range configs {
-				if strings.HasPrefix(requestPath, proxyPath.Prefix) {
-					urlOut, err := url.Parse(proxyPath.Target)
-					if err != nil {
-						doError(responseWriter, request, err)
-						return
-					}
-					urlOut.Path = requestPath
-					urlOut.RawQuery = request.URL.RawQuery
-					request.URL = urlOut
-					log.Printf("Dev Proxy to %s", urlOut.String())
-					if err := doProxy(responseWriter, request, proxyClient); err != nil {
-						log.Printf("ERROR: %s", err.Error())
-						responseWriter.WriteHeader(http.StatusBadGateway)
-					}
+			for i, proxyConfig := range configs {
+				if strings.HasPrefix(request.URL.Path, proxyConfig.Prefix) {
+					proxies[i].ServeHTTP(responseWriter, request)
 					return
 				}
 			}
@@ -47,29 +50,115 @@ func ProxyPaths(configs []ProxyConfig) func(http.Handler) http.Handler {
 	}
 }
 
-func doProxy(clientResponseWriter http.ResponseWriter, clientRequest *http.Request, clientForUpstream *http.Client) error {
-	body, err := ioutil.ReadAll(clientRequest.Body)
-	clientRequest.Body.Close()
+func newReverseProxy(proxyConfig ProxyConfig) *httputil.ReverseProxy {
+	target, err := url.Parse(proxyConfig.Target)
 	if err != nil {
-		return err
+		log.Fatalf("Invalid proxy target %q: %s", proxyConfig.Target, err.Error())
 	}
-	upstreamRequest, err := http.NewRequest(clientRequest.Method, clientRequest.URL.String(), bytes.NewReader(body))
-	if err != nil {
-		return err
+
+	timeout := defaultProxyTimeout
+	if proxyConfig.Timeout > 0 {
+		timeout = proxyConfig.Timeout
 	}
 
-	copyHeaders(clientRequest.Header, upstreamRequest.Header)
-	upstreamRequest.Header.Del("Content-Length") // Allow the http lib to handle this
+	proxy := &httputil.ReverseProxy{
+		Director: func(request *http.Request) {
+			setForwardedHeaders(request)
 
-	upstreamResponse, err := clientForUpstream.Do(upstreamRequest)
-	if err != nil {
-		return err
+			request.URL.Scheme = target.Scheme
+			request.URL.Host = target.Host
+			request.URL.Path = joinPath(target.Path, request.URL.Path)
+			request.URL.RawQuery = mergeQuery(target.RawQuery, request.URL.RawQuery)
+			request.Host = target.Host
+
+			if proxyConfig.RewriteBody {
+				// http.Transport only auto-decompresses a response when the
+				// outgoing request has no Accept-Encoding of its own; real
+				// clients always send one, which would otherwise hand
+				// rewriteAbsoluteURLs a still-gzipped body it can't rewrite.
+				request.Header.Set("Accept-Encoding", "identity")
+			}
+
+			log.Printf("Dev Proxy to %s", request.URL.String())
+		},
+		Transport: &http.Transport{
+			ResponseHeaderTimeout: timeout,
+		},
+	}
+
+	if proxyConfig.RewriteBody {
+		proxy.ModifyResponse = rewriteAbsoluteURLs(proxyConfig.Prefix, target)
 	}
-	defer upstreamResponse.Body.Close()
 
-	copyHeaders(upstreamResponse.Header, clientResponseWriter.Header())
-	clientResponseWriter.WriteHeader(upstreamResponse.StatusCode)
+	return proxy
+}
+
+// joinPath joins a target's base path with a request's path, matching the
+// behaviour of httputil.NewSingleHostReverseProxy: it avoids a doubled or
+// missing slash at the join point instead of simply concatenating the two.
+func joinPath(base, suffix string) string {
+	baseSlash := strings.HasSuffix(base, "/")
+	suffixSlash := strings.HasPrefix(suffix, "/")
+	switch {
+	case baseSlash && suffixSlash:
+		return base + suffix[1:]
+	case !baseSlash && !suffixSlash:
+		return base + "/" + suffix
+	}
+	return base + suffix
+}
 
-	_, err = io.Copy(clientResponseWriter, upstreamResponse.Body)
-	return err
+// mergeQuery combines a target's base query string with the incoming
+// request's query string, again matching httputil.NewSingleHostReverseProxy.
+func mergeQuery(base, suffix string) string {
+	if base == "" || suffix == "" {
+		return base + suffix
+	}
+	return base + "&" + suffix
+}
+
+func setForwardedHeaders(request *http.Request) {
+	if clientIP, _, err := net.SplitHostPort(request.RemoteAddr); err == nil {
+		if prior := request.Header.Get("X-Forwarded-For"); prior != "" {
+			clientIP = prior + ", " + clientIP
+		}
+		request.Header.Set("X-Forwarded-For", clientIP)
+	}
+
+	proto := "http"
+	if request.TLS != nil {
+		proto = "https"
+	}
+	request.Header.Set("X-Forwarded-Proto", proto)
+
+	if request.Host != "" {
+		request.Header.Set("X-Forwarded-Host", request.Host)
+	}
+}
+
+// rewriteAbsoluteURLs returns a ReverseProxy.ModifyResponse that, for JSON
+// responses, replaces absolute URLs pointing at target with prefix - so
+// clients keep talking to this proxy instead of the real upstream.
+func rewriteAbsoluteURLs(prefix string, target *url.URL) func(*http.Response) error {
+	targetOrigin := []byte(target.Scheme + "://" + target.Host)
+	replacement := []byte(prefix)
+
+	return func(response *http.Response) error {
+		if !strings.Contains(response.Header.Get("Content-Type"), "json") {
+			return nil
+		}
+
+		body, err := ioutil.ReadAll(response.Body)
+		response.Body.Close()
+		if err != nil {
+			return err
+		}
+
+		rewritten := bytes.ReplaceAll(body, targetOrigin, replacement)
+
+		response.Body = ioutil.NopCloser(bytes.NewReader(rewritten))
+		response.ContentLength = int64(len(rewritten))
+		response.Header.Set("Content-Length", fmt.Sprintf("%d", len(rewritten)))
+		return nil
+	}
 }
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"net/http"
+	"path"
+	"strings"
+)
+
+// Rule is a single declarative rewrite/redirect rule, loaded from the JSON
+// file pointed to by $SPA_PROXY_RULES. Rules are evaluated in order; the
+// first one whose Match applies has its Action run, and no further rules are
+// considered.
+type Rule struct {
+	Match  RuleMatch  `json:"match"`
+	Action RuleAction `json:"action"`
+}
+
+// RuleMatch selects which requests a Rule applies to. A zero-value field is
+// not checked, so an empty RuleMatch matches every request.
+type RuleMatch struct {
+	Method string `json:"method,omitempty"`
+
+	// Path is matched against the request path with path.Match, e.g.
+	// "/old/*".
+	Path string `json:"path,omitempty"`
+
+	// NoExtension matches requests whose path has no file extension, the
+	// SPA entry-point fallthrough.
+	NoExtension bool `json:"noExtension,omitempty"`
+
+	Header      string `json:"header,omitempty"`
+	HeaderValue string `json:"headerValue,omitempty"`
+
+	Cookie      string `json:"cookie,omitempty"`
+	CookieValue string `json:"cookieValue,omitempty"`
+}
+
+func (m RuleMatch) matches(req *http.Request) bool {
+	if m.Method != "" && !strings.EqualFold(m.Method, req.Method) {
+		return false
+	}
+
+	if m.Path != "" {
+		ok, err := path.Match(m.Path, req.URL.Path)
+		if err != nil || !ok {
+			return false
+		}
+	}
+
+	if m.NoExtension && path.Ext(req.URL.Path) != "" {
+		return false
+	}
+
+	if m.Header != "" {
+		value := req.Header.Get(m.Header)
+		if value == "" || (m.HeaderValue != "" && value != m.HeaderValue) {
+			return false
+		}
+	}
+
+	if m.Cookie != "" {
+		cookie, err := req.Cookie(m.Cookie)
+		if err != nil {
+			return false
+		}
+		if m.CookieValue != "" && cookie.Value != m.CookieValue {
+			return false
+		}
+	}
+
+	return true
+}
+
+// RuleAction is the effect of a matched Rule. Type selects which of the
+// remaining fields apply: "rewrite", "redirect", "add_cookie",
+// "delete_cookie", "set_header" or "remove_header".
+type RuleAction struct {
+	Type string `json:"type"`
+
+	// rewrite
+	Path string `json:"path,omitempty"`
+
+	// redirect
+	Status   int    `json:"status,omitempty"`
+	Location string `json:"location,omitempty"`
+
+	// add_cookie / delete_cookie / set_header / remove_header
+	Name        string      `json:"name,omitempty"`
+	Value       string      `json:"value,omitempty"`
+	CookieAttrs CookieAttrs `json:"cookieAttrs,omitempty"`
+}
+
+// CookieAttrs carries the optional attributes for an add_cookie action.
+type CookieAttrs struct {
+	Path     string `json:"path,omitempty"`
+	Domain   string `json:"domain,omitempty"`
+	MaxAge   int    `json:"maxAge,omitempty"`
+	HTTPOnly bool   `json:"httpOnly,omitempty"`
+	Secure   bool   `json:"secure,omitempty"`
+}
+
+// apply runs the action against the in-flight request/response. It returns
+// true if the action has written a complete response and the handler chain
+// should stop here.
+func (a RuleAction) apply(rw http.ResponseWriter, req *http.Request) (terminal bool) {
+	switch a.Type {
+	case "rewrite":
+		req.URL.Path = a.Path
+
+	case "redirect":
+		status := a.Status
+		if status == 0 {
+			status = http.StatusFound
+		}
+		http.Redirect(rw, req, a.Location, status)
+		return true
+
+	case "add_cookie":
+		http.SetCookie(rw, &http.Cookie{
+			Name:     a.Name,
+			Value:    a.Value,
+			Path:     a.CookieAttrs.Path,
+			Domain:   a.CookieAttrs.Domain,
+			MaxAge:   a.CookieAttrs.MaxAge,
+			HttpOnly: a.CookieAttrs.HTTPOnly,
+			Secure:   a.CookieAttrs.Secure,
+		})
+
+	case "delete_cookie":
+		http.SetCookie(rw, &http.Cookie{
+			Name:   a.Name,
+			Path:   a.CookieAttrs.Path,
+			MaxAge: -1,
+		})
+
+	case "set_header":
+		rw.Header().Set(a.Name, a.Value)
+
+	case "remove_header":
+		rw.Header().Del(a.Name)
+	}
+
+	return false
+}
+
+// RuleEngine evaluates an ordered list of Rules as http.Handler middleware.
+type RuleEngine struct {
+	rules []Rule
+}
+
+// DefaultRuleEngine reproduces the previous hard-coded behaviour: requests
+// for a path with no extension fall through to /index.html.
+func DefaultRuleEngine() *RuleEngine {
+	return &RuleEngine{
+		rules: []Rule{
+			{
+				Match:  RuleMatch{NoExtension: true},
+				Action: RuleAction{Type: "rewrite", Path: "/index.html"},
+			},
+		},
+	}
+}
+
+// LoadRuleEngine reads a RuleEngine's rules from a JSON file, in the format
+// loaded by $SPA_PROXY_RULES.
+func LoadRuleEngine(filename string) (*RuleEngine, error) {
+	rules := []Rule{}
+	if err := loadJSONFile(filename, &rules); err != nil {
+		return nil, err
+	}
+	return &RuleEngine{rules: rules}, nil
+}
+
+// Middleware applies the first matching rule to each request, then either
+// stops (for a terminal action like redirect) or continues to next.
+func (re *RuleEngine) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		for _, rule := range re.rules {
+			if !rule.Match.matches(req) {
+				continue
+			}
+			if rule.Action.apply(rw, req) {
+				return
+			}
+			break
+		}
+		next.ServeHTTP(rw, req)
+	})
+}